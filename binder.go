@@ -0,0 +1,179 @@
+package master
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"master/log"
+)
+
+// Binder creates one or more listeners from the scheme-stripped portion
+// of an address string, e.g. "host:port" for scheme "tcp", "5" for
+// scheme "fd", or a systemd socket name for scheme "systemd".
+type Binder func(rest string) ([]*net.Listener, error)
+
+var (
+	binderMu sync.RWMutex
+	binders  = map[string]Binder{}
+)
+
+// RegisterBinder adds or replaces the Binder used for scheme, letting
+// callers plug in additional listener sources (einhorn, TLS-wrapped,
+// SO_REUSEPORT, ...) without modifying this package.
+func RegisterBinder(scheme string, fn Binder) {
+	binderMu.Lock()
+	defer binderMu.Unlock()
+	binders[scheme] = fn
+}
+
+func lookupBinder(scheme string) (Binder, bool) {
+	binderMu.RLock()
+	defer binderMu.RUnlock()
+	fn, ok := binders[scheme]
+	return fn, ok
+}
+
+func init() {
+	RegisterBinder("tcp", bindTCP)
+	RegisterBinder("unix", bindUnix)
+	RegisterBinder("unixpacket", bindUnixpacket)
+	RegisterBinder("fd", bindFd)
+	RegisterBinder("systemd", bindSystemd)
+}
+
+// splitScheme splits an address of the form "scheme://rest" or
+// "scheme@rest" into its scheme and the remainder. Addresses with
+// neither separator are treated as bare "tcp" addresses.
+func splitScheme(addr string) (scheme, rest string) {
+	if i := strings.Index(addr, "://"); i >= 0 {
+		return addr[:i], addr[i+len("://"):]
+	}
+	if i := strings.Index(addr, "@"); i >= 0 {
+		return addr[:i], addr[i+1:]
+	}
+	return "tcp", addr
+}
+
+func bindTCP(addr string) ([]*net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return []*net.Listener{&ln}, nil
+}
+
+func bindUnix(addr string) ([]*net.Listener, error) {
+	// A socket file left behind by a previous run makes net.Listen fail
+	// with EADDRINUSE even though nothing is listening; startDiag
+	// removes its unix socket the same way before binding.
+	os.Remove(addr)
+	ln, err := net.Listen("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	return []*net.Listener{&ln}, nil
+}
+
+func bindUnixpacket(addr string) ([]*net.Listener, error) {
+	os.Remove(addr)
+	ln, err := net.Listen("unixpacket", addr)
+	if err != nil {
+		return nil, err
+	}
+	return []*net.Listener{&ln}, nil
+}
+
+// bindFd adopts an already-open, inherited file descriptor named by
+// "fd@<n>", the same semantics getListeners() uses for the supervisor
+// fd range but addressable one at a time.
+func bindFd(rest string) ([]*net.Listener, error) {
+	fd, err := strconv.Atoi(rest)
+	if err != nil {
+		return nil, fmt.Errorf("fd: invalid descriptor %q: %s", rest, err)
+	}
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("fd@%d", fd))
+	ln, err := net.FileListener(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	// FileListener dups fd internally, so the original file must be
+	// closed here too or each adopted socket leaks one descriptor.
+	file.Close()
+	return []*net.Listener{&ln}, nil
+}
+
+// bindSystemd adopts sockets passed via systemd socket activation
+// (LISTEN_PID/LISTEN_FDS/LISTEN_FDNAMES), matching by name when one is
+// given in "systemd@<name>"; an empty name adopts every passed fd.
+func bindSystemd(name string) ([]*net.Listener, error) {
+	fds, names, err := systemdListenFds()
+	if err != nil {
+		return nil, err
+	}
+
+	listeners := []*net.Listener(nil)
+	for i, fd := range fds {
+		if name != "" && (i >= len(names) || names[i] != name) {
+			continue
+		}
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("systemd@%s", name))
+		ln, err := net.FileListener(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		file.Close()
+		listeners = append(listeners, &ln)
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("systemd: no socket matching name=%q", name)
+	}
+	return listeners, nil
+}
+
+const systemdFdStart = 3
+
+func systemdListenFds() ([]int, []string, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil, fmt.Errorf("systemd: LISTEN_PID not set for this process")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil, fmt.Errorf("systemd: LISTEN_FDS not set")
+	}
+
+	fds := make([]int, n)
+	for i := 0; i < n; i++ {
+		fds[i] = systemdFdStart + i
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	return fds, names, nil
+}
+
+// getListenersByAddrs binds one address per entry, dispatching on its
+// scheme prefix: tcp://, unix://, unixpacket://, fd@<n> for an
+// inherited descriptor, or systemd@<name> for a socket-activated one.
+func getListenersByAddrs(addrs []string) []*net.Listener {
+	listeners := []*net.Listener(nil)
+	for _, addr := range addrs {
+		scheme, rest := splitScheme(addr)
+		fn, ok := lookupBinder(scheme)
+		if !ok {
+			panic(fmt.Sprintf("no binder registered for scheme=%q, addr=%s", scheme, addr))
+		}
+
+		lns, err := fn(rest)
+		if err != nil {
+			panic(fmt.Sprintf("listen error=\"%s\", addr=%s", err, addr))
+		}
+		log.Tracef("net", "bound addr=%s via scheme=%s", addr, scheme)
+		listeners = append(listeners, lns...)
+	}
+	return listeners
+}
@@ -0,0 +1,32 @@
+package master
+
+import "testing"
+
+func TestSplitScheme(t *testing.T) {
+	cases := []struct {
+		addr       string
+		wantScheme string
+		wantRest   string
+	}{
+		{"tcp://127.0.0.1:8080", "tcp", "127.0.0.1:8080"},
+		{"unix:///var/run/master.sock", "unix", "/var/run/master.sock"},
+		{"unixpacket:///var/run/master.sock", "unixpacket", "/var/run/master.sock"},
+		{"fd@5", "fd", "5"},
+		{"systemd@app.socket", "systemd", "app.socket"},
+		{"127.0.0.1:8080", "tcp", "127.0.0.1:8080"},
+	}
+
+	for _, c := range cases {
+		scheme, rest := splitScheme(c.addr)
+		if scheme != c.wantScheme || rest != c.wantRest {
+			t.Errorf("splitScheme(%q) = (%q, %q), want (%q, %q)",
+				c.addr, scheme, rest, c.wantScheme, c.wantRest)
+		}
+	}
+}
+
+func TestBindFdInvalidDescriptor(t *testing.T) {
+	if _, err := bindFd("not-a-number"); err == nil {
+		t.Error("bindFd with a non-numeric descriptor should error")
+	}
+}
@@ -0,0 +1,236 @@
+package master
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sync"
+	"time"
+
+	"master/log"
+)
+
+// Diagnostics agent, modeled on gops-style agents: a small unix socket
+// that answers single-byte commands with either a short text summary
+// or a raw pprof/trace capture, so operators can inspect a running
+// master without recompiling or sending signals.
+
+type diagCmd byte
+
+const (
+	diagConnCount diagCmd = iota
+	diagListeners
+	diagGoroutines
+	diagHeapSummary
+	diagProfileCPU
+	diagProfileHeap
+	diagProfileGoroutine
+	diagProfileBlock
+	diagTrace
+)
+
+var diagCmdNames = map[string]diagCmd{
+	"conns":            diagConnCount,
+	"listeners":        diagListeners,
+	"goroutines":       diagGoroutines,
+	"heap":             diagHeapSummary,
+	"cpuprofile":       diagProfileCPU,
+	"heapprofile":      diagProfileHeap,
+	"goroutineprofile": diagProfileGoroutine,
+	"blockprofile":     diagProfileBlock,
+	"trace":            diagTrace,
+}
+
+var (
+	// diagMu guards diagListener, diagPath and currentListeners,
+	// which are written from the main path (startDiag/stopDiag,
+	// Listeners(), monitorMaster) and read from the accept and conn
+	// handler goroutines below.
+	diagMu       sync.Mutex
+	diagListener net.Listener
+	diagPath     string
+
+	// currentListeners is populated by Listeners() (and by
+	// monitorMaster for the stateFd-driven path) so the diag agent
+	// can report the live listener set.
+	currentListeners []*net.Listener
+)
+
+// setCurrentListeners records the listener set Listeners() just bound.
+func setCurrentListeners(listeners []*net.Listener) {
+	diagMu.Lock()
+	currentListeners = listeners
+	diagMu.Unlock()
+}
+
+// getCurrentListeners returns the listener set most recently recorded
+// by setCurrentListeners.
+func getCurrentListeners() []*net.Listener {
+	diagMu.Lock()
+	defer diagMu.Unlock()
+	return currentListeners
+}
+
+// startDiag starts the diagnostics agent on a unix socket at addr, if
+// addr is non-empty. It is a no-op otherwise.
+func startDiag(addr string) {
+	if len(addr) == 0 {
+		return
+	}
+
+	os.Remove(addr)
+	ln, err := net.Listen("unix", addr)
+	if err != nil {
+		log.Errorf("diag: listen %s error %s", addr, err)
+		return
+	}
+
+	diagMu.Lock()
+	diagListener = ln
+	diagPath = addr
+	diagMu.Unlock()
+	log.Infof("diag: listening on %s", addr)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleDiagConn(conn)
+		}
+	}()
+}
+
+// stopDiag closes the diag socket and removes it from disk. Safe to
+// call even if startDiag was never called.
+func stopDiag() {
+	diagMu.Lock()
+	ln, path := diagListener, diagPath
+	diagListener, diagPath = nil, ""
+	diagMu.Unlock()
+
+	if ln != nil {
+		ln.Close()
+	}
+	if len(path) > 0 {
+		os.Remove(path)
+	}
+}
+
+func handleDiagConn(conn net.Conn) {
+	defer conn.Close()
+
+	var hdr [1]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return
+	}
+
+	switch diagCmd(hdr[0]) {
+	case diagConnCount:
+		fmt.Fprintf(conn, "connCount=%d\n", connCountCur())
+	case diagListeners:
+		for _, ln := range getCurrentListeners() {
+			fmt.Fprintf(conn, "%s\n", (*ln).Addr())
+		}
+	case diagGoroutines:
+		fmt.Fprintf(conn, "goroutines=%d\n", runtime.NumGoroutine())
+	case diagHeapSummary:
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		fmt.Fprintf(conn, "alloc=%d totalAlloc=%d sys=%d numGC=%d\n",
+			m.Alloc, m.TotalAlloc, m.Sys, m.NumGC)
+	case diagProfileCPU:
+		secs := readDiagSeconds(conn)
+		pprof.StartCPUProfile(conn)
+		time.Sleep(time.Duration(secs) * time.Second)
+		pprof.StopCPUProfile()
+	case diagProfileHeap:
+		pprof.Lookup("heap").WriteTo(conn, 0)
+	case diagProfileGoroutine:
+		pprof.Lookup("goroutine").WriteTo(conn, 0)
+	case diagProfileBlock:
+		pprof.Lookup("block").WriteTo(conn, 0)
+	case diagTrace:
+		secs := readDiagSeconds(conn)
+		if err := trace.Start(conn); err != nil {
+			fmt.Fprintf(conn, "trace start error %s\n", err)
+			return
+		}
+		time.Sleep(time.Duration(secs) * time.Second)
+		trace.Stop()
+	default:
+		fmt.Fprintf(conn, "unknown command %d\n", hdr[0])
+	}
+}
+
+func readDiagSeconds(conn net.Conn) uint32 {
+	var buf [4]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		return 1
+	}
+	n := binary.BigEndian.Uint32(buf[:])
+	if n == 0 {
+		n = 1
+	}
+	return n
+}
+
+// DiagClient dials a diag socket at addr and runs cmd (one of "conns",
+// "listeners", "goroutines", "heap", "cpuprofile", "heapprofile",
+// "goroutineprofile", "blockprofile" or "trace"), returning the raw
+// response. cpuprofile and trace take a duration in seconds.
+func DiagClient(addr, cmd string, seconds uint32) ([]byte, error) {
+	code, ok := diagCmdNames[cmd]
+	if !ok {
+		return nil, fmt.Errorf("diag: unknown command %q", cmd)
+	}
+
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte{byte(code)}); err != nil {
+		return nil, err
+	}
+	if code == diagProfileCPU || code == diagTrace {
+		var buf [4]byte
+		binary.BigEndian.PutUint32(buf[:], seconds)
+		if _, err := conn.Write(buf[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	return io.ReadAll(conn)
+}
+
+// RunDiagCLI implements the "master diag <addr> <cmd> [seconds]"
+// subcommand: it dials addr, runs cmd, and writes the response to
+// stdout. It returns a process exit code.
+func RunDiagCLI(args []string) int {
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: master diag <addr> <cmd> [seconds]")
+		return 2
+	}
+
+	var seconds uint32 = 1
+	if len(args) >= 3 {
+		fmt.Sscanf(args[2], "%d", &seconds)
+	}
+
+	out, err := DiagClient(args[0], args[1], seconds)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "diag: %s\n", err)
+		return 1
+	}
+
+	os.Stdout.Write(out)
+	return 0
+}
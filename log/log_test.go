@@ -0,0 +1,59 @@
+package log
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoadTraceAndTrace(t *testing.T) {
+	cases := []struct {
+		env      string
+		facility string
+		want     bool
+	}{
+		{"", "net", false},
+		{"net", "net", true},
+		{"net", "fd", false},
+		{"net,fd", "fd", true},
+		{"net, fd ", "fd", true},
+		{"all", "anything", true},
+		{"net,all", "fd", true},
+	}
+
+	for _, c := range cases {
+		loadTrace(c.env)
+		if got := Trace(c.facility); got != c.want {
+			t.Errorf("MASTER_TRACE=%q: Trace(%q) = %v, want %v", c.env, c.facility, got, c.want)
+		}
+	}
+}
+
+func TestTracefBypassesLevelGate(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	SetLevel(LevelError)
+	defer SetLevel(LevelInfo)
+	defer SetOutput(os.Stderr)
+
+	loadTrace("net")
+
+	buf.Reset()
+	Tracef("net", "hello %d", 1)
+	if !strings.Contains(buf.String(), "hello 1") {
+		t.Errorf("Tracef for an enabled facility produced no output (level gate still applied?): got %q", buf.String())
+	}
+
+	buf.Reset()
+	Tracef("other", "should not print")
+	if buf.Len() != 0 {
+		t.Errorf("Tracef for a disabled facility printed: %q", buf.String())
+	}
+
+	buf.Reset()
+	Debugf("should not print, below level")
+	if buf.Len() != 0 {
+		t.Errorf("Debugf printed below the logger's minimum level: %q", buf.String())
+	}
+}
@@ -0,0 +1,387 @@
+package master
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"master/log"
+)
+
+// chroot drops root privileges in the fixed order real privilege-
+// separating daemons use: chroot -> chdir("/") -> setgroups ->
+// setgid -> setuid. Privileged resources must already be open by the
+// time this runs: Prepare opens the master_log file and Listeners()
+// binds the listeners while still root; this package opens no pidfile.
+// preJailHandler then gets one last chance to open anything else
+// before the drop. Each step is verified, and
+// when MasterUnprivileged is set, any failure aborts the process
+// rather than continuing with privileges still attached.
+func chroot() {
+	if len(masterArgs) == 0 || !privilege || len(username) == 0 {
+		return
+	}
+
+	u, err := user.Lookup(username)
+	if err != nil {
+		privStep("lookup "+username, err)
+		return
+	}
+
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		privStep("parse gid="+u.Gid, err)
+		return
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		privStep("parse uid="+u.Uid, err)
+		return
+	}
+
+	// Supplementary groups must be resolved before chroot(2): group
+	// lookups go through NSS, which typically can't see /etc/group
+	// once jailed.
+	gids, err := supplementaryGids(u)
+	if err != nil {
+		log.Errorf("GroupIds %s error %s", username, err)
+	}
+
+	retainCaps, err := parseCapabilities(capNames)
+	if err != nil {
+		log.Errorf("master_capabilities: %s", err)
+	}
+	if len(retainCaps) > 0 {
+		if _, _, errno := syscall.Syscall(syscall.SYS_PRCTL, prSetKeepCaps, 1, 0); errno != 0 {
+			log.Errorf("prctl(PR_SET_KEEPCAPS) error %s", errno)
+		}
+	}
+
+	if preJailHandler != nil {
+		preJailHandler()
+	}
+
+	// Under MasterUnprivileged, privStep aborts the process on the
+	// first failure. Otherwise a failed chroot/chdir must not skip
+	// the uid/gid drop below it: a best-effort operator who asked for
+	// a chroot that couldn't be set up still needs setuid/setgid to
+	// run, or the process is left running as root.
+	if privStep("chroot", doChroot()) {
+		privStep("chdir", syscall.Chdir("/"))
+	}
+
+	privStep("setgroups", syscall.Setgroups(gids))
+	privStep("setgid", syscall.Setgid(gid))
+	uidOK := privStep("setuid", syscall.Setuid(uid))
+
+	if uidOK && len(retainCaps) > 0 {
+		if err := capsetRetain(retainCaps); err != nil {
+			log.Errorf("capset error %s", err)
+		} else {
+			log.Tracef("jail", "retained capabilities: %v", capNames)
+		}
+	}
+}
+
+func doChroot() error {
+	if !chrootOn || len(rootDir) == 0 {
+		return nil
+	}
+	return syscall.Chroot(rootDir)
+}
+
+// privStep logs the outcome of one privilege-drop step. When
+// MasterUnprivileged is set, a failing step is fatal: continuing would
+// mean serving traffic with privileges we were explicitly told to
+// shed.
+func privStep(step string, err error) bool {
+	if err != nil {
+		if MasterUnprivileged {
+			log.Fatalf("%s failed, refusing to continue unprivileged: %s", step, err)
+		}
+		log.Errorf("%s error %s", step, err)
+		return false
+	}
+	log.Tracef("jail", "%s ok", step)
+	return true
+}
+
+func supplementaryGids(u *user.User) ([]int, error) {
+	idStrs, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+
+	gids := make([]int, 0, len(idStrs))
+	for _, s := range idStrs {
+		gid, err := strconv.Atoi(s)
+		if err != nil {
+			continue
+		}
+		gids = append(gids, gid)
+	}
+	return gids, nil
+}
+
+// Linux capabilities (0-31) recognized in master_capabilities. Only
+// the low 32 bits are supported, which covers every capability in
+// common use.
+var capByName = map[string]uint32{
+	"chown":            0,
+	"dac_override":     1,
+	"dac_read_search":  2,
+	"fowner":           3,
+	"fsetid":           4,
+	"kill":             5,
+	"setgid":           6,
+	"setuid":           7,
+	"setpcap":          8,
+	"linux_immutable":  9,
+	"net_bind_service": 10,
+	"net_broadcast":    11,
+	"net_admin":        12,
+	"net_raw":          13,
+	"ipc_lock":         14,
+	"ipc_owner":        15,
+	"sys_module":       16,
+	"sys_rawio":        17,
+	"sys_chroot":       18,
+	"sys_ptrace":       19,
+	"sys_pacct":        20,
+	"sys_admin":        21,
+	"sys_boot":         22,
+	"sys_nice":         23,
+	"sys_resource":     24,
+	"sys_time":         25,
+	"sys_tty_config":   26,
+	"mknod":            27,
+	"lease":            28,
+	"audit_write":      29,
+	"audit_control":    30,
+	"setfcap":          31,
+}
+
+func parseCapabilities(names []string) ([]uint32, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	caps := make([]uint32, 0, len(names))
+	for _, name := range names {
+		c, ok := capByName[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown capability %q", name)
+		}
+		caps = append(caps, c)
+	}
+	return caps, nil
+}
+
+const prSetKeepCaps = 8 // linux/prctl.h PR_SET_KEEPCAPS
+
+// capUserHeader/capUserData mirror struct __user_cap_header_struct and
+// struct __user_cap_data_struct from linux/capability.h for the
+// capset(2) syscall.
+type capUserHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capUserData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+const capsetVersion3 = 0x20080522
+
+// capsetRetain drops every capability except caps from the calling
+// thread's effective/permitted/inheritable sets. It's called right
+// after setuid, once PR_SET_KEEPCAPS has kept the full set alive
+// across the uid change.
+func capsetRetain(caps []uint32) error {
+	hdr := capUserHeader{version: capsetVersion3, pid: 0}
+	var data [2]capUserData
+	for _, c := range caps {
+		idx := c / 32
+		bit := uint32(1) << (c % 32)
+		data[idx].effective |= bit
+		data[idx].permitted |= bit
+		data[idx].inheritable |= bit
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_CAPSET,
+		uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Privilege-separated child: some operations (binding a low port
+// after SIGHUP, rotating a root-owned log file) still need root even
+// after chroot() has dropped it for good. Rather than fork(2), which
+// is unsafe once the Go runtime has started extra threads, the
+// privileged process re-execs itself with a socketpair wired to fd 3;
+// the child drops privileges as usual and asks its parent to perform
+// anything that still needs root.
+
+const (
+	privsepChildEnv = "MASTER_PRIVSEP_CHILD"
+	privsepChildFd  = 3
+)
+
+// RootOpFunc handles one request a privsep child sends to its
+// privileged parent, returning the response text or an error.
+type RootOpFunc func(op string, args []string) (string, error)
+
+// MaybeBecomeChild reports whether this process is the child half of
+// a privsep pair started by BecomeParent, returning the
+// *net.UnixConn connected back to the privileged parent if so. Call
+// it early in main(). Neither this function nor BecomeParent changes
+// the child's credentials: the child starts with the parent's
+// privileges, drops them through the usual chroot() path, and uses
+// conn (via RequestRoot) for anything that still needs root.
+func MaybeBecomeChild() (conn *net.UnixConn, ok bool) {
+	if os.Getenv(privsepChildEnv) != "1" {
+		return nil, false
+	}
+
+	file := os.NewFile(uintptr(privsepChildFd), "privsep-child")
+	c, err := net.FileConn(file)
+	if err != nil {
+		log.Errorf("privsep: FileConn error %s", err)
+		return nil, false
+	}
+	uconn, ok := c.(*net.UnixConn)
+	if !ok {
+		log.Errorf("privsep: fd %d is not a unix socket", privsepChildFd)
+		return nil, false
+	}
+	return uconn, true
+}
+
+// BecomeParent re-execs the current binary as a privsep child wired
+// to a fresh socketpair and serves handler for every request the
+// child sends until the child exits. Call it from the root process in
+// place of running the service directly. If the process also calls
+// StartSignals, call it before BecomeParent: the SIGCHLD reaper and
+// this function's wait for the child's exit would otherwise both
+// race to Wait4 the same pid, so the child's waiter is registered with
+// the reaper (under childSpawnMu, right after Start()) instead of
+// calling cmd.Wait() directly.
+func BecomeParent(handler RootOpFunc) error {
+	pair, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return err
+	}
+
+	parentFile := os.NewFile(uintptr(pair[0]), "privsep-parent")
+	childFile := os.NewFile(uintptr(pair[1]), "privsep-child")
+	defer parentFile.Close()
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = append(os.Environ(), privsepChildEnv+"=1")
+	cmd.ExtraFiles = []*os.File{childFile}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// childSpawnMu held across Start()+registerChildWait: reapChildren
+	// takes the same lock before its Wait4 loop, so the reaper can't
+	// run between the child existing and its waiter being registered.
+	// Without this, a child that exits the instant Start() returns
+	// could be reaped first, and waitForChild's wait below would block
+	// forever with no sender.
+	childSpawnMu.Lock()
+	if err := cmd.Start(); err != nil {
+		childSpawnMu.Unlock()
+		childFile.Close()
+		return err
+	}
+	var waitCh <-chan syscall.WaitStatus
+	if signalsStarted {
+		waitCh = registerChildWait(cmd.Process.Pid)
+	}
+	childSpawnMu.Unlock()
+	childFile.Close()
+
+	rootConn, err := net.FileConn(parentFile)
+	if err != nil {
+		return err
+	}
+	uconn, ok := rootConn.(*net.UnixConn)
+	if !ok {
+		return fmt.Errorf("privsep: socketpair fd is not a unix socket")
+	}
+
+	go serveRootRequests(uconn, handler)
+
+	return waitForChild(cmd, waitCh)
+}
+
+// waitForChild waits for the privsep child to exit. waitCh is non-nil
+// when StartSignals' SIGCHLD reaper is running and already registered
+// for cmd's pid before this was called (see BecomeParent): the reaper
+// owns the only safe Wait4 call for this process, so a second,
+// independent cmd.Wait() here would race it for the same pid. When
+// waitCh is nil, no reaper is running and cmd.Wait() is safe directly.
+func waitForChild(cmd *exec.Cmd, waitCh <-chan syscall.WaitStatus) error {
+	if waitCh == nil {
+		return cmd.Wait()
+	}
+
+	ws := <-waitCh
+	if ws.Signaled() {
+		return fmt.Errorf("privsep child pid=%d killed by signal %s", cmd.Process.Pid, ws.Signal())
+	}
+	if ws.ExitStatus() != 0 {
+		return fmt.Errorf("privsep child pid=%d exited with status %d", cmd.Process.Pid, ws.ExitStatus())
+	}
+	return nil
+}
+
+func serveRootRequests(conn *net.UnixConn, handler RootOpFunc) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		resp, err := handler(fields[0], fields[1:])
+		if err != nil {
+			fmt.Fprintf(conn, "err %s\n", err)
+			continue
+		}
+		fmt.Fprintf(conn, "ok %s\n", resp)
+	}
+}
+
+// RequestRoot asks the privileged parent over conn (as returned by
+// MaybeBecomeChild) to run op with args, blocking for the response.
+func RequestRoot(conn *net.UnixConn, op string, args ...string) (string, error) {
+	if _, err := fmt.Fprintf(conn, "%s %s\n", op, strings.Join(args, " ")); err != nil {
+		return "", err
+	}
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\n")
+
+	if strings.HasPrefix(line, "err ") {
+		return "", fmt.Errorf("%s", strings.TrimPrefix(line, "err "))
+	}
+	return strings.TrimPrefix(line, "ok "), nil
+}
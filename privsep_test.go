@@ -0,0 +1,37 @@
+package master
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCapabilities(t *testing.T) {
+	cases := []struct {
+		names   []string
+		want    []uint32
+		wantErr bool
+	}{
+		{nil, nil, false},
+		{[]string{}, nil, false},
+		{[]string{"net_bind_service"}, []uint32{10}, false},
+		{[]string{"NET_BIND_SERVICE", "sys_chroot"}, []uint32{10, 18}, false},
+		{[]string{"not_a_real_cap"}, nil, true},
+	}
+
+	for _, c := range cases {
+		got, err := parseCapabilities(c.names)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("parseCapabilities(%v): expected error, got none", c.names)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCapabilities(%v): unexpected error %s", c.names, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseCapabilities(%v) = %v, want %v", c.names, got, c.want)
+		}
+	}
+}
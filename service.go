@@ -3,14 +3,15 @@ package master
 import (
 	"flag"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"os"
-	"os/user"
 	"strconv"
+	"strings"
 	"sync"
-	"syscall"
 	"time"
+
+	"master/log"
 )
 
 const (
@@ -45,10 +46,12 @@ var (
 )
 
 var (
-	logPath    string
-	username   string
-	masterArgs string
-	rootDir    string
+	logPath     string
+	username    string
+	masterArgs  string
+	rootDir     string
+	listenAddrs []string
+	capNames    []string
 )
 
 var (
@@ -74,6 +77,10 @@ func init() {
 }
 
 func parseArgs() {
+	if len(os.Args) > 2 && os.Args[1] == "diag" {
+		os.Exit(RunDiagCLI(os.Args[2:]))
+	}
+
 	var n = len(os.Args)
 	for i := 0; i < n; i++ {
 		switch os.Args[i] {
@@ -109,7 +116,7 @@ func parseArgs() {
 		}
 	}
 
-	log.Printf("listenFdCount=%d, sockType=%s, services=%s",
+	log.Infof("listenFdCount=%d, sockType=%s, services=%s",
 		listenFdCount, sockType, services)
 }
 
@@ -127,12 +134,13 @@ func Prepare() {
 
 	logPath = conf.Get("master_log")
 	if len(logPath) > 0 {
-		f, err := os.OpenFile(logPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		f, err := log.FileSink(logPath)
 		if err != nil {
 			fmt.Printf("OpenFile %s error %s", logPath, err)
+		} else if conf.Get("master_log_stderr") == "1" {
+			log.SetOutput(io.MultiWriter(os.Stderr, f))
 		} else {
 			log.SetOutput(f)
-			//log.SetOutput(io.MultiWriter(os.Stderr, f))
 		}
 	}
 
@@ -140,62 +148,43 @@ func Prepare() {
 	username = conf.Get("fiber_owner")
 	rootDir = conf.Get("fiber_queue_dir")
 
-	log.Printf("Args: %s\r\n", masterArgs)
-}
-
-func chroot() {
-	if len(masterArgs) == 0 || !privilege || len(username) == 0 {
-		return
-	}
-
-	user, err := user.Lookup(username)
-	if err != nil {
-		log.Printf("Lookup %s error %s", username, err)
-	} else {
-		gid, err := strconv.Atoi(user.Gid)
-		if err != nil {
-			log.Printf("invalid gid=%s, %s", user.Gid, err)
-		} else if err := syscall.Setgid(gid); err != nil {
-			log.Printf("Setgid error %s", err)
-		} else {
-			log.Printf("Setgid ok")
-		}
-
-		uid, err := strconv.Atoi(user.Uid)
-		if err != nil {
-			log.Printf("invalid uid=%s, %s", user.Uid, err)
-		} else if err := syscall.Setuid(uid); err != nil {
-			log.Printf("Setuid error %s", err)
-		} else {
-			log.Printf("Setuid ok")
+	if Alone {
+		for _, addr := range strings.Split(conf.Get("master_listen"), ",") {
+			addr = strings.TrimSpace(addr)
+			if len(addr) > 0 {
+				listenAddrs = append(listenAddrs, addr)
+			}
 		}
 	}
 
-	if chrootOn && len(rootDir) > 0 {
-		err := syscall.Chroot(rootDir)
-		if err != nil {
-			log.Printf("Chroot error %s, path %s", err, rootDir)
-		} else {
-			log.Printf("Chroot ok, path %s", rootDir)
-			err := syscall.Chdir("/")
-			if err != nil {
-				log.Printf("Chdir error %s", err)
-			} else {
-				log.Printf("Chdir ok")
-			}
+	for _, capName := range strings.Split(conf.Get("master_capabilities"), ",") {
+		capName = strings.TrimSpace(capName)
+		if len(capName) > 0 {
+			capNames = append(capNames, capName)
 		}
 	}
+
+	startDiag(conf.Get("master_diag_addr"))
+
+	log.Infof("Args: %s", masterArgs)
 }
 
-func getListenersByAddrs(addrs []string) []*net.Listener {
-	listeners := []*net.Listener(nil)
-	for _, addr := range addrs {
-		ln, err := net.Listen("tcp", addr)
-		if err != nil {
-			panic(fmt.Sprintf("listen error=\"%s\", addr=%s", err, addr))
-		}
-		listeners = append(listeners, &ln)
+// Listeners returns the listeners this process should serve. In Alone
+// mode, addresses configured via "master_listen" are bound directly
+// through the Binder registry; otherwise listeners are inherited from
+// the supervisor's fd range as before. The result is recorded as
+// currentListeners so both the diag agent and a signal-driven drain
+// (StartSignals, for standalone daemons with no stateFd supervisor)
+// can see and close them.
+func Listeners() []*net.Listener {
+	var listeners []*net.Listener
+	if Alone && len(listenAddrs) > 0 {
+		listeners = getListenersByAddrs(listenAddrs)
+	} else {
+		listeners = getListeners()
 	}
+
+	setCurrentListeners(listeners)
 	return listeners
 }
 
@@ -206,11 +195,11 @@ func getListeners() []*net.Listener {
 		ln, err := net.FileListener(file)
 		if err != nil {
 			file.Close()
-			log.Println(fmt.Sprintf("create FileListener error=\"%s\", fd=%d", err, fd))
+			log.Errorf("create FileListener error=\"%s\", fd=%d", err, fd)
 			continue
 		}
 		listeners = append(listeners, &ln)
-		log.Printf("add fd: %d", fd)
+		log.Infof("add fd: %d", fd)
 	}
 	return listeners
 }
@@ -218,57 +207,62 @@ func getListeners() []*net.Listener {
 func monitorMaster(listeners []*net.Listener,
 	onStopHandler func(), stopHandler func(bool)) {
 
+	setCurrentListeners(listeners)
+	defer stopDiag()
+
 	file := os.NewFile(uintptr(stateFd), "")
 	conn, err := net.FileConn(file)
 	if err != nil {
-		log.Println("FileConn error", err)
+		log.Errorf("FileConn error %s", err)
 	}
 
-	log.Println("waiting master exiting ...")
+	log.Tracef("conn", "waiting master exiting ...")
 
 	buf := make([]byte, 1024)
 	_, err = conn.Read(buf)
 	if err != nil {
-		log.Println("disconnected from master", err)
+		log.Errorf("disconnected from master %s", err)
 	}
 
-	var n, i int
-	n = 0
-	i = 0
+	drainConns(onStopHandler)
+
+	log.Infof("master disconnected, exiting now")
 
+	stopHandler(true)
+}
+
+// drainConns stops accepting new connections and blocks until
+// connCount reaches zero or waitExit seconds have passed. It backs
+// both the stateFd-driven shutdown in monitorMaster and the
+// signal-driven one in StartSignals.
+func drainConns(onStopHandler func()) {
 	stopping = true
 
 	if onStopHandler != nil {
 		onStopHandler()
 	} else {
 		// XXX: force stopping listen again
-		for _, ln := range listeners {
-			log.Println("Closing one listener")
+		for _, ln := range getCurrentListeners() {
+			log.Infof("Closing one listener")
 			(*ln).Close()
 		}
 	}
 
+	i := 0
 	for {
-		connMutex.RLock()
-		if connCount <= 0 {
-			connMutex.RUnlock()
+		n := connCountCur()
+		if n <= 0 {
 			break
 		}
 
-		n = connCount
-		connMutex.RUnlock()
 		time.Sleep(time.Second) // sleep 1 second
 		i++
-		log.Printf("exiting, clients=%d, sleep=%d seconds", n, i)
+		log.Infof("exiting, clients=%d, sleep=%d seconds", n, i)
 		if waitExit > 0 && i >= waitExit {
-			log.Printf("waiting too long >= %d", waitExit)
+			log.Warnf("waiting too long >= %d", waitExit)
 			break
 		}
 	}
-
-	log.Println("master disconnected, exiting now")
-
-	stopHandler(true)
 }
 
 func connCountInc() {
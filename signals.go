@@ -0,0 +1,148 @@
+package master
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"master/log"
+)
+
+// ReloadFunc is invoked on SIGHUP, typically to re-read Config and
+// rotate the master_log file.
+type ReloadFunc func()
+
+// ChildFunc is invoked once per child reaped after SIGCHLD.
+type ChildFunc func(pid int, ws syscall.WaitStatus)
+
+var (
+	reloadHandler ReloadFunc = nil
+	childHandler  ChildFunc  = nil
+
+	// signalsStarted reports whether StartSignals' SIGCHLD reaper is
+	// running. BecomeParent consults it to decide how to learn its
+	// child's exit status: Wait4(-1, WNOHANG) reaps whatever child
+	// exits first, privsep or not, so once the reaper is running it
+	// must be the only caller of wait4 for that pid — a second,
+	// independent cmd.Wait() would race it and see ECHILD.
+	signalsStarted bool
+
+	childWaitersMu sync.Mutex
+	childWaiters   = map[int]chan syscall.WaitStatus{}
+
+	// childSpawnMu serializes reapChildren against the start+register
+	// sequence in BecomeParent: without it, a child that exits the
+	// instant cmd.Start() returns could be reaped before
+	// registerChildWait runs, leaving its status routed to OnChild (or
+	// dropped) and waitForChild blocked forever with no sender. Holding
+	// this lock across both critical sections closes that window
+	// instead of relying on signal-delivery timing.
+	childSpawnMu sync.Mutex
+)
+
+// OnReload registers handler to run on SIGHUP.
+func OnReload(handler ReloadFunc) {
+	reloadHandler = handler
+}
+
+// OnChild registers handler to run for each pid reaped after SIGCHLD.
+func OnChild(handler ChildFunc) {
+	childHandler = handler
+}
+
+var signalsOnce sync.Once
+
+// StartSignals lets a service run standalone as a proper daemon,
+// independent of the supervisor's status fd: SIGTERM/SIGINT/SIGQUIT
+// trigger the same graceful drain monitorMaster performs when the
+// parent closes stateFd, SIGHUP runs the OnReload handler, and SIGCHLD
+// reaps every exited child via Wait4(-1, WNOHANG), dispatching each to
+// OnChild. onStopHandler and stopHandler have the same meaning as the
+// matching arguments to monitorMaster.
+func StartSignals(onStopHandler func(), stopHandler func(bool)) {
+	signalsOnce.Do(func() {
+		signalsStarted = true
+
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch,
+			syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT,
+			syscall.SIGHUP, syscall.SIGCHLD)
+
+		go func() {
+			for sig := range ch {
+				switch sig {
+				case syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT:
+					log.Infof("signal %s received, draining", sig)
+					drainConns(onStopHandler)
+					if stopHandler != nil {
+						stopHandler(true)
+					}
+				case syscall.SIGHUP:
+					log.Infof("SIGHUP received, reloading")
+					if reloadHandler != nil {
+						reloadHandler()
+					}
+				case syscall.SIGCHLD:
+					reapChildren()
+				}
+			}
+		}()
+	})
+}
+
+// reapChildren drains every already-exited child with a non-blocking
+// Wait4 loop, stopping at ECHILD (no children left) or pid==0 (none
+// exited yet).
+func reapChildren() {
+	childSpawnMu.Lock()
+	defer childSpawnMu.Unlock()
+
+	for {
+		var ws syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+		if err != nil {
+			if err != syscall.ECHILD {
+				log.Errorf("Wait4 error %s", err)
+			}
+			return
+		}
+		if pid <= 0 {
+			return
+		}
+
+		log.Tracef("conn", "reaped child pid=%d status=%v", pid, ws)
+
+		// A waiter registered via registerChildWait (BecomeParent)
+		// owns this pid's status; don't also hand it to the generic
+		// OnChild handler, which would see the same exit twice.
+		if waiter := takeChildWaiter(pid); waiter != nil {
+			waiter <- ws
+			continue
+		}
+
+		if childHandler != nil {
+			childHandler(pid, ws)
+		}
+	}
+}
+
+// registerChildWait asks the SIGCHLD reaper to deliver pid's
+// WaitStatus on the returned channel instead of to OnChild, for a
+// caller (BecomeParent) that needs to wait on that one child
+// specifically without racing the reaper's own Wait4 call.
+func registerChildWait(pid int) <-chan syscall.WaitStatus {
+	ch := make(chan syscall.WaitStatus, 1)
+	childWaitersMu.Lock()
+	childWaiters[pid] = ch
+	childWaitersMu.Unlock()
+	return ch
+}
+
+func takeChildWaiter(pid int) chan syscall.WaitStatus {
+	childWaitersMu.Lock()
+	defer childWaitersMu.Unlock()
+	ch := childWaiters[pid]
+	delete(childWaiters, pid)
+	return ch
+}